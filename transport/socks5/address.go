@@ -0,0 +1,33 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"io"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/socks5/statute"
+)
+
+// appendSOCKS5Address appends the SOCKS5 wire representation of address (ATYP, ADDR
+// and PORT, as defined in RFC 1928, Section 5) to b, returning the extended slice.
+func appendSOCKS5Address(b []byte, address string) ([]byte, error) {
+	return statute.AppendAddr(b, address)
+}
+
+// readSOCKS5Address reads an ATYP-tagged ADDR and PORT from r and returns it as a
+// "host:port" string. atyp must be one of the addrType* constants.
+func readSOCKS5Address(r io.Reader, atyp byte) (string, error) {
+	return statute.ReadAddr(r, atyp)
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// Authenticator implements the client side of a SOCKS5 authentication method, run as
+// a sub-negotiation after the server selects it during method selection (RFC 1928,
+// Section 3). Callers can implement this interface to support methods beyond
+// username/password, such as GSSAPI (RFC 1961) or a private challenge/response
+// scheme, and register them with [Dialer.RegisterAuthenticator].
+type Authenticator interface {
+	// Method returns the METHOD byte this authenticator handles.
+	Method() byte
+	// Authenticate runs the method's sub-negotiation over sc, which is connected to
+	// the SOCKS5 proxy. It returns an error if the server rejects the credentials.
+	Authenticate(sc transport.StreamConn) error
+}
+
+const usernamePasswordSubnegotiationVersion = 0x01
+
+// usernamePasswordAuthenticator implements username/password authentication, as
+// defined in RFC 1929.
+type usernamePasswordAuthenticator struct {
+	username, password string
+}
+
+func (a *usernamePasswordAuthenticator) Method() byte {
+	return methodUsernamePassword
+}
+
+func (a *usernamePasswordAuthenticator) Authenticate(sc transport.StreamConn) error {
+	if len(a.username) > 255 || len(a.password) > 255 {
+		return fmt.Errorf("username and password must each be at most 255 bytes")
+	}
+	req := []byte{usernamePasswordSubnegotiationVersion, byte(len(a.username))}
+	req = append(req, a.username...)
+	req = append(req, byte(len(a.password)))
+	req = append(req, a.password...)
+	if _, err := sc.Write(req); err != nil {
+		return fmt.Errorf("failed to send username/password: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(sc, reply); err != nil {
+		return fmt.Errorf("failed to read username/password reply: %w", err)
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("username/password authentication failed with status %#x", reply[1])
+	}
+	return nil
+}
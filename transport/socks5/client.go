@@ -0,0 +1,264 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// Dialer implements the client side of the SOCKS5 protocol, as defined in RFC 1928,
+// supporting the CONNECT, BIND, and UDP ASSOCIATE commands.
+type Dialer struct {
+	sd           transport.StreamDialer
+	pd           transport.PacketDialer
+	proxyAddress string
+
+	// LocalPacketAddr, if set, is advertised as the DST.ADDR/DST.PORT of the UDP
+	// ASSOCIATE request, so that servers which restrict datagram sources by that
+	// field (RFC 1928, Section 7) see the client's actual local UDP endpoint rather
+	// than the unspecified "0.0.0.0:0".
+	//
+	// There is no equivalent option for CONNECT or BIND: in both, DST.ADDR/DST.PORT
+	// already carries a value the protocol requires for another purpose (the
+	// destination to connect to, and the expected peer to accept a connection
+	// from, respectively), so neither request has a field left to advertise the
+	// client's own local endpoint. UDP ASSOCIATE is the only command where
+	// DST.ADDR/DST.PORT describes the client rather than a remote party.
+	LocalPacketAddr net.Addr
+
+	// EnableUDPFragmentation turns on reassembly of fragmented SOCKS5 UDP datagrams
+	// (RFC 1928, Section 7) in packetConn.Read, and fragmentation of oversized
+	// datagrams in packetConn.Write. It's off by default, since most SOCKS5 servers
+	// never fragment and some reject fragmented requests outright.
+	EnableUDPFragmentation bool
+
+	// FragmentMTU caps the size of each fragment (SOCKS5 UDP header plus payload)
+	// written when EnableUDPFragmentation is enabled. It defaults to
+	// udpDefaultFragmentMTU when zero or negative.
+	FragmentMTU int
+
+	// authenticators holds the registered authentication methods, keyed by METHOD byte.
+	authenticators map[byte]Authenticator
+	// methodOrder lists the METHOD bytes offered during method selection, most
+	// preferred first. It always ends with methodNoAuthRequired.
+	methodOrder []byte
+
+	// Logger, if non-nil, receives diagnostic messages about the UDP ASSOCIATE
+	// handshake (e.g. the bind address the proxy reports). If nil, nothing is logged.
+	Logger *slog.Logger
+}
+
+func (d *Dialer) logf(format string, args ...any) {
+	if d.Logger != nil {
+		d.Logger.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+var _ transport.StreamDialer = (*Dialer)(nil)
+
+// NewDialer creates a [Dialer] that reaches the SOCKS5 proxy at proxyAddress via sd,
+// and dials the UDP relay endpoints the proxy advertises in UDP ASSOCIATE replies via pd.
+// It offers no authentication by default; see [Dialer.SetCredentials] and
+// [Dialer.RegisterAuthenticator] to require a method the proxy demands.
+func NewDialer(sd transport.StreamDialer, pd transport.PacketDialer, proxyAddress string) *Dialer {
+	return &Dialer{sd: sd, pd: pd, proxyAddress: proxyAddress, methodOrder: []byte{methodNoAuthRequired}}
+}
+
+// RegisterAuthenticator adds a to the set of methods offered during method
+// selection, preferred over any previously registered method (and over the
+// no-authentication-required method, which is always offered as a fallback).
+// Registering a method a second time replaces it without changing its preference.
+func (d *Dialer) RegisterAuthenticator(a Authenticator) {
+	if d.authenticators == nil {
+		d.authenticators = make(map[byte]Authenticator)
+	}
+	method := a.Method()
+	if _, exists := d.authenticators[method]; !exists {
+		d.methodOrder = append([]byte{method}, d.methodOrder...)
+	}
+	d.authenticators[method] = a
+}
+
+// SetCredentials registers username/password authentication (RFC 1929) using user
+// and pass, preferred over the no-authentication-required method.
+func (d *Dialer) SetCredentials(user, pass string) {
+	d.RegisterAuthenticator(&usernamePasswordAuthenticator{username: user, password: pass})
+}
+
+// DialStream implements [transport.StreamDialer] by issuing a CONNECT request for dstAddr.
+func (d *Dialer) DialStream(ctx context.Context, dstAddr string) (transport.StreamConn, error) {
+	sc, _, err := d.request(ctx, CmdConnect, dstAddr)
+	return sc, err
+}
+
+// request connects to the proxy, negotiates a method, and sends the SOCKS5 request
+// for cmd and dstAddr. It returns the stream connection to the proxy (left open, e.g.
+// as the data channel for CONNECT or the control channel for UDP ASSOCIATE) and the
+// BND.ADDR/BND.PORT reported in the reply.
+func (d *Dialer) request(ctx context.Context, cmd byte, dstAddr string) (transport.StreamConn, string, error) {
+	sc, err := d.sd.DialStream(ctx, d.proxyAddress)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to SOCKS5 proxy: %w", err)
+	}
+	if err := d.negotiateMethod(sc); err != nil {
+		sc.Close()
+		return nil, "", err
+	}
+	bindAddr, err := sendRequest(sc, cmd, dstAddr)
+	if err != nil {
+		sc.Close()
+		return nil, "", err
+	}
+	return sc, bindAddr, nil
+}
+
+// negotiateMethod runs the method-selection sub-negotiation (RFC 1928, Section 3),
+// offering d.methodOrder in preference order, then dispatches to the Authenticator
+// registered for whichever method the server selects.
+func (d *Dialer) negotiateMethod(sc transport.StreamConn) error {
+	methods := d.methodOrder
+	req := make([]byte, 0, 2+len(methods))
+	req = append(req, socks5Version, byte(len(methods)))
+	req = append(req, methods...)
+	if _, err := sc.Write(req); err != nil {
+		return fmt.Errorf("failed to send method selection: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(sc, reply); err != nil {
+		return fmt.Errorf("failed to read method selection reply: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version in method selection reply: %#x", reply[0])
+	}
+
+	selected := reply[1]
+	switch selected {
+	case methodNoAcceptable:
+		return fmt.Errorf("server rejected all offered authentication methods")
+	case methodNoAuthRequired:
+		return nil
+	}
+	auth, ok := d.authenticators[selected]
+	if !ok {
+		return fmt.Errorf("server selected an authentication method we did not offer: %#x", selected)
+	}
+	return auth.Authenticate(sc)
+}
+
+// sendRequest sends the SOCKS5 request for cmd and dstAddr over sc, and parses the reply.
+func sendRequest(sc transport.StreamConn, cmd byte, dstAddr string) (string, error) {
+	if err := writeRequest(sc, cmd, dstAddr); err != nil {
+		return "", err
+	}
+	// Read straight from sc, not through a buffered reader, so that no bytes past the
+	// reply are consumed from what becomes the data channel.
+	return readReply(sc)
+}
+
+// writeRequest sends the SOCKS5 request (RFC 1928, Section 4) for cmd and dstAddr over sc.
+func writeRequest(sc transport.StreamConn, cmd byte, dstAddr string) error {
+	req := []byte{socks5Version, cmd, 0x00}
+	req, err := appendSOCKS5Address(req, dstAddr)
+	if err != nil {
+		return fmt.Errorf("failed to append destination address: %w", err)
+	}
+	if _, err := sc.Write(req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	return nil
+}
+
+// readReply reads and parses one SOCKS5 reply (RFC 1928, Section 6) from r, returning
+// the BND.ADDR/BND.PORT it reports.
+func readReply(r io.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", fmt.Errorf("failed to read reply header: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version in reply: %#x", header[0])
+	}
+	if header[1] != repSucceeded {
+		return "", fmt.Errorf("SOCKS5 request failed with reply code %#x", header[1])
+	}
+
+	bindAddr, err := readSOCKS5Address(r, header[3])
+	if err != nil {
+		return "", fmt.Errorf("failed to read bound address: %w", err)
+	}
+	return bindAddr, nil
+}
+
+// DialBind implements the BIND command (RFC 1928, Section 4): it asks the proxy to
+// listen for a single incoming connection from expectedPeer (which may be
+// "0.0.0.0:0" if the peer's address isn't known in advance) and returns a [BindConn]
+// reporting the address the proxy is listening on. Callers typically pass that
+// address to the peer out-of-band, then call [BindConn.Accept] once it connects.
+func (d *Dialer) DialBind(ctx context.Context, expectedPeer string) (*BindConn, error) {
+	sc, err := d.sd.DialStream(ctx, d.proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy: %w", err)
+	}
+	if err := d.negotiateMethod(sc); err != nil {
+		sc.Close()
+		return nil, err
+	}
+	if err := writeRequest(sc, CmdBind, expectedPeer); err != nil {
+		sc.Close()
+		return nil, err
+	}
+
+	bindAddr, err := readReply(sc)
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return &BindConn{sc: sc, BindAddr: bindAddr}, nil
+}
+
+// BindConn is a pending SOCKS5 BIND request (RFC 1928, Section 4), returned by
+// [Dialer.DialBind].
+type BindConn struct {
+	sc transport.StreamConn
+
+	// BindAddr is the address, reported by the proxy's first reply, that the
+	// expected peer should be told to connect to.
+	BindAddr string
+}
+
+// Accept blocks until the proxy sends its second reply, reporting that the expected
+// peer has connected, then returns the data connection and the address the proxy
+// reports the peer connected from. The returned connection is the same one used for
+// the BIND request, reused as the data channel as required by RFC 1928.
+func (b *BindConn) Accept() (transport.StreamConn, string, error) {
+	peerAddr, err := readReply(b.sc)
+	if err != nil {
+		b.sc.Close()
+		return nil, "", err
+	}
+	return b.sc, peerAddr, nil
+}
+
+// Close abandons the pending BIND request.
+func (b *BindConn) Close() error {
+	return b.sc.Close()
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeMethodServer starts a listener that reads a method-selection request and
+// replies with the fixed bytes in reply, then closes the connection. It's used to
+// exercise method-negotiation failure modes a real Server would never produce.
+func startFakeMethodServer(t *testing.T, reply []byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		conn.Write(reply)
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialerMethodNegotiationNoAcceptableMethods(t *testing.T) {
+	proxyAddr := startFakeMethodServer(t, []byte{socks5Version, methodNoAcceptable})
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	_, err := dialer.DialStream(context.Background(), "example.com:443")
+	require.ErrorContains(t, err, "rejected all offered authentication methods")
+}
+
+func TestDialerMethodNegotiationUnofferedMethod(t *testing.T) {
+	proxyAddr := startFakeMethodServer(t, []byte{socks5Version, methodUsernamePassword})
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	_, err := dialer.DialStream(context.Background(), "example.com:443")
+	require.ErrorContains(t, err, "did not offer")
+}
+
+func TestDialerUsernamePasswordBadCredentials(t *testing.T) {
+	echoAddr := startEchoTCPServer(t)
+	srv := &Server{
+		StreamDialer: &transport.TCPDialer{},
+		PacketDialer: &transport.UDPDialer{},
+		Authenticate: func(user, password string) bool {
+			return user == "alice" && password == "correct-horse"
+		},
+	}
+	proxyAddr := startTestServer(t, srv)
+
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	dialer.SetCredentials("alice", "wrong-password")
+	_, err := dialer.DialStream(context.Background(), echoAddr)
+	require.ErrorContains(t, err, "authentication failed")
+}
+
+// startFakeBindServer starts a listener that completes method negotiation with
+// methodNoAuthRequired, reads one SOCKS5 BIND request, and replies with firstReply.
+// Calling the returned sendSecond func sends secondReply on the same connection. It's
+// used to exercise Dialer.DialBind, since Server doesn't implement the BIND command.
+func startFakeBindServer(t *testing.T, firstReply, secondReply []byte) (addr string, sendSecond func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		conn.Write([]byte{socks5Version, methodNoAuthRequired})
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		if _, err := readSOCKS5Address(conn, req[3]); err != nil {
+			return
+		}
+		conn.Write(firstReply)
+		accepted <- conn
+	}()
+
+	return ln.Addr().String(), func() {
+		conn := <-accepted
+		conn.Write(secondReply)
+	}
+}
+
+func TestDialerBind(t *testing.T) {
+	firstReply := []byte{socks5Version, repSucceeded, 0x00, addrTypeIPv4, 127, 0, 0, 1, 0x1F, 0x90}
+	secondReply := []byte{socks5Version, repSucceeded, 0x00, addrTypeIPv4, 203, 0, 113, 5, 0x00, 0x50}
+	proxyAddr, sendSecond := startFakeBindServer(t, firstReply, secondReply)
+
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	bind, err := dialer.DialBind(context.Background(), "0.0.0.0:0")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:8080", bind.BindAddr)
+
+	sendSecond()
+	conn, peerAddr, err := bind.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "203.0.113.5:80", peerAddr)
+}
+
+func TestDialerUsernamePasswordSuccess(t *testing.T) {
+	echoAddr := startEchoTCPServer(t)
+	srv := &Server{
+		StreamDialer: &transport.TCPDialer{},
+		PacketDialer: &transport.UDPDialer{},
+		Authenticate: func(user, password string) bool {
+			return user == "alice" && password == "correct-horse"
+		},
+	}
+	proxyAddr := startTestServer(t, srv)
+
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	dialer.SetCredentials("alice", "correct-horse")
+	conn, err := dialer.DialStream(context.Background(), echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hi"))
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hi", string(buf))
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import "github.com/Jigsaw-Code/outline-sdk/transport/socks5/statute"
+
+// Protocol constants defined by RFC 1928 (SOCKS Protocol Version 5).
+
+const (
+	socks5Version = 0x05
+
+	// Commands, sent by the client in the request.
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+)
+
+// Address types, sent as the ATYP field of an address. Aliased from [statute] so the
+// wire format has a single source of truth shared with the UDP header codec.
+const (
+	addrTypeIPv4       = statute.AtypIPv4
+	addrTypeDomainName = statute.AtypDomainName
+	addrTypeIPv6       = statute.AtypIPv6
+)
+
+// Reply codes, sent by the server as the REP field of a reply.
+const (
+	repSucceeded               = 0x00
+	repGeneralFailure          = 0x01
+	repConnectionNotAllowed    = 0x02
+	repNetworkUnreachable      = 0x03
+	repHostUnreachable         = 0x04
+	repConnectionRefused       = 0x05
+	repTTLExpired              = 0x06
+	repCommandNotSupported     = 0x07
+	repAddressTypeNotSupported = 0x08
+)
+
+// Authentication methods, negotiated during the method-selection sub-negotiation.
+const (
+	methodNoAuthRequired   = 0x00
+	methodUsernamePassword = 0x02
+	methodNoAcceptable     = 0xFF
+)
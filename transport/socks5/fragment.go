@@ -0,0 +1,84 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/socks5/statute"
+)
+
+// udpDefaultFragmentMTU is the default cap, in bytes, on the size of a SOCKS5 UDP
+// request header plus payload used when splitting a datagram into fragments.
+const udpDefaultFragmentMTU = 1500
+
+// udpFragmentReassemblyTimeout is the maximum time to wait for the next fragment of
+// a sequence before discarding it, per the reassembly timeout mandated by RFC 1928.
+const udpFragmentReassemblyTimeout = 5 * time.Second
+
+// parseUDPRequest parses the SOCKS5 UDP request header (RFC 1928, Section 7) at the
+// start of buf, returning the FRAG byte, the DST.ADDR/DST.PORT as a "host:port"
+// string, and the remaining payload.
+func parseUDPRequest(buf []byte) (frag byte, dstAddr string, payload []byte, err error) {
+	header, payload, err := statute.ParseUDPHeader(buf)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return header.Frag, header.Addr, payload, nil
+}
+
+// fragmentReassembler tracks the in-progress reassembly of a fragmented SOCKS5 UDP
+// datagram (RFC 1928, Section 7): fragments 1..127, sent in order, with the high bit
+// of FRAG set on the last fragment of the sequence.
+type fragmentReassembler struct {
+	seq      byte // sequence number of the last fragment appended; 0 means none in progress
+	data     []byte
+	deadline time.Time
+}
+
+// append folds one fragment into r. It returns the reassembled datagram and done =
+// true once the terminating fragment has been appended. An out-of-order fragment, or
+// one received after the reassembly timeout, discards the sequence in progress
+// (done = false, err = nil) so the caller can keep waiting for a fresh one.
+func (r *fragmentReassembler) append(frag byte, payload []byte) (data []byte, done bool, err error) {
+	seq := frag &^ 0x80
+	isLast := frag&0x80 != 0
+	if seq == 0 || seq > 127 {
+		return nil, false, fmt.Errorf("invalid SOCKS5 UDP fragment number %#x", frag)
+	}
+
+	if seq == 1 || r.seq == 0 || time.Now().After(r.deadline) {
+		r.seq = 0
+		r.data = nil
+	}
+	if seq != r.seq+1 {
+		r.seq = 0
+		r.data = nil
+		return nil, false, nil
+	}
+
+	r.seq = seq
+	r.data = append(r.data, payload...)
+	r.deadline = time.Now().Add(udpFragmentReassemblyTimeout)
+	if !isLast {
+		return nil, false, nil
+	}
+
+	data = r.data
+	r.seq = 0
+	r.data = nil
+	return data, true, nil
+}
@@ -18,16 +18,36 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/socks5/statute"
 )
 
+// maxUDPDatagramSize is the largest possible UDP datagram, used to size the scratch
+// buffers Read/ReadFrom use to avoid truncating a datagram at the socket read.
+const maxUDPDatagramSize = 65536
+
+// udpReadScratchPool holds reusable buffers for reading a datagram when the
+// caller-supplied buffer is too small to safely read a full datagram into directly.
+var udpReadScratchPool = sync.Pool{
+	New: func() any { return make([]byte, maxUDPDatagramSize) },
+}
+
 type packetConn struct {
 	dstAddr net.Addr
 	pc      net.Conn
 	sc      transport.StreamConn
+
+	// fragEnabled and fragMTU mirror Dialer.EnableUDPFragmentation and
+	// Dialer.FragmentMTU at the time the packetConn was created.
+	fragEnabled bool
+	fragMTU     int
+
+	frag fragmentReassembler
 }
 
 var _ net.Conn = (*packetConn)(nil)
@@ -53,75 +73,129 @@ func (c *packetConn) SetWriteDeadline(t time.Time) error {
 	return c.pc.SetWriteDeadline(t)
 }
 
+// Read implements net.Conn by reading the payload of one (possibly reassembled)
+// datagram into b. It returns io.ErrShortBuffer, without consuming any further
+// datagrams, if the payload doesn't fit in b.
 func (c *packetConn) Read(b []byte) (int, error) {
-	// TODO: read header
-	buffer := make([]byte, 65536) // Maximum size for UDP packet
-	n, err := c.pc.Read(buffer)
-	if err != nil {
-		return 0, err
-	}
-	// Minimum size of header is 10 bytes
-	if n < 10 {
-		return 0, fmt.Errorf("invalid SOCKS5 UDP packet: too short")
-	}
+	n, _, err := c.readFrom(b)
+	return n, err
+}
 
-	// Start parsing the header
-	rsv := buffer[:2]
-	if rsv[0] != 0x00 || rsv[1] != 0x00 {
-		return 0, fmt.Errorf("invalid reserved bytes: expected 0x0000, got %#x%#x", rsv[0], rsv[1])
-	}
+// ReadFrom behaves like Read, but also returns the address the datagram's SOCKS5
+// header reports it came from. Use this instead of Read when the packetConn may
+// relay datagrams from more than one origin, e.g. when its Dialer is fronting a
+// relay server rather than a single destination.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.readFrom(b)
+}
 
-	frag := buffer[2]
-	if frag != 0 {
-		return 0, fmt.Errorf("fragmentation is not supported")
+func (c *packetConn) readFrom(b []byte) (int, net.Addr, error) {
+	// A buffer too small to possibly hold a full datagram can't be read into
+	// directly: the socket read would silently truncate it before we ever get a
+	// chance to detect that and report io.ErrShortBuffer. Fall back to a pooled
+	// scratch buffer in that case. This must key off len(b), not cap(b): b may be
+	// a sub-slice of a larger buffer, and reading into b[:cap(b)] would write past
+	// what the caller gave us permission to touch.
+	var raw []byte
+	if len(b) < maxUDPDatagramSize {
+		raw = udpReadScratchPool.Get().([]byte)
+		defer udpReadScratchPool.Put(raw) //nolint:staticcheck // reusing a plain []byte is fine here
+	} else {
+		raw = b
 	}
 
-	atyp := buffer[3]
-	addrLen := 0
-	switch atyp {
-	case addrTypeIPv4:
-		addrLen = net.IPv4len
-	case addrTypeIPv6:
-		addrLen = net.IPv6len
-	case addrTypeDomainName:
-		// Domain name's first byte is the length of the name
-		addrLen = int(buffer[4]) + 1 // +1 for the length byte itself
-	default:
-		return 0, fmt.Errorf("unknown address type %#x", atyp)
-	}
+	for {
+		n, err := c.pc.Read(raw)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		frag, srcAddr, payload, err := parseUDPRequest(raw[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if frag == 0 {
+			// A standalone datagram aborts any fragment sequence in progress.
+			c.frag = fragmentReassembler{}
+		} else {
+			if !c.fragEnabled {
+				return 0, nil, fmt.Errorf("fragmentation is not supported")
+			}
+			data, done, err := c.frag.append(frag, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			if !done {
+				continue
+			}
+			payload = data
+		}
+
+		if len(payload) > len(b) {
+			return 0, nil, io.ErrShortBuffer
+		}
+		// payload may alias b (when raw is b); copy handles the overlap since it
+		// always shifts data toward the front of the buffer.
+		copy(b, payload)
 
-	// Calculate the start position of the actual data
-	headerLength := 4 + addrLen + 2 // RSV (2) + FRAG (1) + ATYP (1) + ADDR (variable) + PORT (2)
-	if n < headerLength {
-		return 0, fmt.Errorf("invalid SOCKS5 UDP packet: header too short")
+		addr, err := transport.MakeNetAddr("udp", srcAddr)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to parse source address: %w", err)
+		}
+		return len(payload), addr, nil
 	}
+}
 
-	// Copy the payload into the provided buffer
-	payloadLength := n - headerLength
-	if payloadLength > len(b) {
-		// maybe raise an error to indicate that the provided buffer is too small?
-		payloadLength = len(b)
+func (c *packetConn) Write(b []byte) (int, error) {
+	header, err := statute.UDPHeader{Addr: c.dstAddr.String()}.MarshalBinary()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build SOCKS5 UDP header: %w", err)
 	}
-	copy(b, buffer[headerLength:n])
 
-	return payloadLength, nil
+	if !c.fragEnabled || len(header)+len(b) <= c.fragMTU {
+		if _, err := c.pc.Write(append(header, b...)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return len(b), c.writeFragmented(len(header), b)
 }
 
-func (c *packetConn) Write(b []byte) (int, error) {
-	// Encapsulate the payload in a SOCKS5 UDP packet
-	header := []byte{
-		0x00, 0x00, // Reserved
-		0x00, // Fragment number
-		// To be appended below: ATYP, IPv4, IPv6, Domain name
-		// To be appended below: IP and port (destination address)
+// writeFragmented splits b into a sequence of fragments, each no larger than
+// c.fragMTU including header, and writes them in order terminated by a fragment
+// with the high bit of FRAG set, per RFC 1928, Section 7.
+func (c *packetConn) writeFragmented(headerLen int, b []byte) error {
+	chunkSize := c.fragMTU - headerLen
+	if chunkSize <= 0 {
+		return fmt.Errorf("fragment MTU %d too small for a %d-byte SOCKS5 UDP header", c.fragMTU, headerLen)
 	}
-	header, err := appendSOCKS5Address(header, c.dstAddr.String())
-	if err != nil {
-		return 0, fmt.Errorf("failed to append SOCKS5 address: %w", err)
+
+	seq := byte(1)
+	for offset := 0; offset < len(b); offset += chunkSize {
+		end := offset + chunkSize
+		isLast := end >= len(b)
+		if isLast {
+			end = len(b)
+		}
+		if seq > 127 {
+			return fmt.Errorf("payload too large to fragment: needs more than 127 fragments at MTU %d", c.fragMTU)
+		}
+
+		frag := seq
+		if isLast {
+			frag |= 0x80
+		}
+		header, err := statute.UDPHeader{Frag: frag, Addr: c.dstAddr.String()}.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("failed to build SOCKS5 UDP header: %w", err)
+		}
+		if _, err := c.pc.Write(append(header, b[offset:end]...)); err != nil {
+			return fmt.Errorf("failed to write fragment %d: %w", seq, err)
+		}
+		seq++
 	}
-	// Combine the header and the payload
-	fullPacket := append(header, b...)
-	return c.pc.Write(fullPacket)
+	return nil
 }
 
 func (c *packetConn) Close() error {
@@ -134,25 +208,27 @@ func (d *Dialer) DialPacket(ctx context.Context, dstAddr string) (net.Conn, erro
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse address: %w", err)
 	}
-	// TODO: how to provide the bind address?
-	sc, bindAddr, err := d.request(ctx, CmdUDPAssociate, "0.0.0.0:0")
-	//fmt.Println("Bound address is:", bindAddr)
+	localAddr := "0.0.0.0:0"
+	if d.LocalPacketAddr != nil {
+		localAddr = d.LocalPacketAddr.String()
+	}
+	sc, bindAddr, err := d.request(ctx, CmdUDPAssociate, localAddr)
 	if err != nil {
 		return nil, err
 	}
+	d.logf("socks5: UDP ASSOCIATE bound to %v", bindAddr)
 
 	host, port, err := net.SplitHostPort(bindAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse bound address: %w", err)
 	}
-	fmt.Printf("bound host is %v, bound port is %v \n", host, port)
 
 	if host == "::" {
 		schost, scPort, err := net.SplitHostPort(sc.RemoteAddr().String())
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse tcp address: %w", err)
 		}
-		fmt.Printf("tcp host is %v, tcp port is %v \n", schost, scPort)
+		d.logf("socks5: using control connection address %v:%v in place of unspecified bind host", schost, scPort)
 		host = schost
 	}
 
@@ -162,5 +238,15 @@ func (d *Dialer) DialPacket(ctx context.Context, dstAddr string) (net.Conn, erro
 		return nil, fmt.Errorf("failed to connect to packet endpoint: %w", err)
 	}
 
-	return &packetConn{netDstAddr, pc, sc}, nil
+	fragMTU := d.FragmentMTU
+	if fragMTU <= 0 {
+		fragMTU = udpDefaultFragmentMTU
+	}
+	return &packetConn{
+		dstAddr:     netDstAddr,
+		pc:          pc,
+		sc:          sc,
+		fragEnabled: d.EnableUDPFragmentation,
+		fragMTU:     fragMTU,
+	}, nil
 }
@@ -0,0 +1,215 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newLoopbackPacketConn opens a UDP socket on the loopback interface, to stand in
+// for the socket a real SOCKS5 server would return in a UDP ASSOCIATE reply, along
+// with a send function that delivers data to it as if from that server.
+func newLoopbackPacketConn(t *testing.T) (conn net.Conn, send func(b []byte)) {
+	t.Helper()
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	conn, err = net.Dial("udp", srv.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	send = func(b []byte) {
+		_, err := srv.WriteToUDP(b, conn.LocalAddr().(*net.UDPAddr))
+		require.NoError(t, err)
+	}
+	return conn, send
+}
+
+func TestPacketConnWriteFragmentsOversizedPayload(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer srv.Close()
+	client, err := net.Dial("udp", srv.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	c := &packetConn{dstAddr: dstAddr, pc: client, fragEnabled: true, fragMTU: 20}
+	payload := make([]byte, 50)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	n, err := c.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, len(payload), n)
+
+	var frags []byte
+	var gotLast bool
+	for !gotLast {
+		buf := make([]byte, 65536)
+		require.NoError(t, srv.SetReadDeadline(time.Now().Add(time.Second)))
+		m, _, err := srv.ReadFrom(buf)
+		require.NoError(t, err)
+		frag := buf[2]
+		require.NotZero(t, frag&0x7F, "fragment number must be 1..127")
+		gotLast = frag&0x80 != 0
+		frags = append(frags, buf[10:m]...)
+	}
+	require.Equal(t, payload, frags)
+}
+
+func TestPacketConnReadReassemblesFragments(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn, rawSend := newLoopbackPacketConn(t)
+	c := &packetConn{dstAddr: dstAddr, pc: conn, fragEnabled: true, fragMTU: udpDefaultFragmentMTU}
+
+	send := func(frag byte, payload []byte) {
+		header, err := appendSOCKS5Address([]byte{0x00, 0x00, frag}, dstAddr.String())
+		require.NoError(t, err)
+		rawSend(append(header, payload...))
+	}
+
+	send(1, []byte("hello, "))
+	send(0x80|2, []byte("world!"))
+
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello, world!", string(buf[:n]))
+}
+
+func TestPacketConnReadRejectsFragmentsWhenDisabled(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn, send := newLoopbackPacketConn(t)
+	c := &packetConn{dstAddr: dstAddr, pc: conn, fragEnabled: false}
+
+	header, err := appendSOCKS5Address([]byte{0x00, 0x00, 0x01}, dstAddr.String())
+	require.NoError(t, err)
+	send(append(header, []byte("partial")...))
+
+	buf := make([]byte, 1024)
+	_, err = c.Read(buf)
+	require.Error(t, err)
+}
+
+func TestPacketConnReadDiscardsOutOfOrderFragments(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn, rawSend := newLoopbackPacketConn(t)
+	c := &packetConn{dstAddr: dstAddr, pc: conn, fragEnabled: true, fragMTU: udpDefaultFragmentMTU}
+
+	send := func(frag byte, payload []byte) {
+		header, err := appendSOCKS5Address([]byte{0x00, 0x00, frag}, dstAddr.String())
+		require.NoError(t, err)
+		rawSend(append(header, payload...))
+	}
+
+	// Fragment 3 arrives before fragment 1 was ever seen: discarded, then a fresh
+	// sequence starting at 1 reassembles correctly.
+	send(3, []byte("stray"))
+	send(1, []byte("re"))
+	send(0x80|2, []byte("start"))
+
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "restart", string(buf[:n]))
+}
+
+func TestPacketConnReadReturnsErrShortBuffer(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn, send := newLoopbackPacketConn(t)
+	c := &packetConn{dstAddr: dstAddr, pc: conn}
+
+	header, err := appendSOCKS5Address([]byte{0x00, 0x00, 0x00}, dstAddr.String())
+	require.NoError(t, err)
+	send(append(header, []byte("too long for the buffer")...))
+
+	buf := make([]byte, 4)
+	_, err = c.Read(buf)
+	require.ErrorIs(t, err, io.ErrShortBuffer)
+}
+
+func TestPacketConnReadUsesZeroCopyFastPathForLargeBuffer(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn, send := newLoopbackPacketConn(t)
+	c := &packetConn{dstAddr: dstAddr, pc: conn}
+
+	header, err := appendSOCKS5Address([]byte{0x00, 0x00, 0x00}, dstAddr.String())
+	require.NoError(t, err)
+	send(append(header, []byte("hello")...))
+
+	// len(buf) >= maxUDPDatagramSize takes the zero-copy fast path, reading
+	// straight into buf instead of a pooled scratch buffer.
+	buf := make([]byte, maxUDPDatagramSize)
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestPacketConnReadDoesNotWritePastLenWhenCapIsLarger(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn, send := newLoopbackPacketConn(t)
+	c := &packetConn{dstAddr: dstAddr, pc: conn}
+
+	header, err := appendSOCKS5Address([]byte{0x00, 0x00, 0x00}, dstAddr.String())
+	require.NoError(t, err)
+	payload := []byte("hello")
+	send(append(header, payload...))
+
+	// arena is large enough that cap(b) >= maxUDPDatagramSize even though b itself
+	// only exposes 3 bytes, the case that used to make the zero-copy fast path read
+	// straight through len(b) into the rest of arena.
+	arena := make([]byte, maxUDPDatagramSize+64)
+	for i := range arena {
+		arena[i] = 0xAA
+	}
+	b := arena[:3]
+	require.GreaterOrEqual(t, cap(b), maxUDPDatagramSize)
+
+	_, err = c.Read(b)
+	require.ErrorIs(t, err, io.ErrShortBuffer)
+	for i := 3; i < len(arena); i++ {
+		require.Equal(t, byte(0xAA), arena[i], "byte at offset %d outside b was modified", i)
+	}
+}
+
+func TestPacketConnReadFromReportsSourceAddress(t *testing.T) {
+	dstAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn, send := newLoopbackPacketConn(t)
+	c := &packetConn{dstAddr: dstAddr, pc: conn}
+
+	header, err := appendSOCKS5Address([]byte{0x00, 0x00, 0x00}, "203.0.113.9:8080")
+	require.NoError(t, err)
+	send(append(header, []byte("payload")...))
+
+	buf := make([]byte, 1024)
+	n, from, err := c.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "payload", string(buf[:n]))
+	require.Equal(t, "203.0.113.9:8080", from.String())
+}
@@ -0,0 +1,346 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/socks5/statute"
+)
+
+// Server is a SOCKS5 proxy server, as defined in RFC 1928, that dispatches CONNECT
+// and UDP ASSOCIATE requests to injectable dialers. It lets tools that already embed
+// the SDK's transports (for censorship circumvention, testing, and so on) expose
+// them to ordinary SOCKS5 clients, instead of only consuming them as a Dialer.
+type Server struct {
+	// StreamDialer dials the outbound connection for CONNECT requests. Required.
+	StreamDialer transport.StreamDialer
+	// PacketDialer dials the outbound sockets relayed for UDP ASSOCIATE requests. Required.
+	PacketDialer transport.PacketDialer
+
+	// Authenticate, if non-nil, enables the username/password method (RFC 1929) and
+	// is called with the credentials offered by the client to decide whether to
+	// accept them. While Authenticate is set, the no-authentication-required method
+	// is not offered, so every client must authenticate.
+	Authenticate func(user, password string) bool
+
+	// Logger receives one line per client connection that fails or is rejected. If
+	// nil, these errors are discarded.
+	Logger *log.Logger
+}
+
+// Serve accepts connections on ln and handles them until ln.Accept returns an
+// error, which it returns. Callers typically run Serve in its own goroutine and
+// stop it by closing ln.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	if err := s.serveConn(conn); err != nil && err != io.EOF {
+		s.logf("socks5: client %v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	if err := s.negotiateMethod(conn); err != nil {
+		return fmt.Errorf("method negotiation failed: %w", err)
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version: %#x", header[0])
+	}
+	cmd := header[1]
+	dstAddr, err := readSOCKS5Address(conn, header[3])
+	if err != nil {
+		return fmt.Errorf("failed to read destination address: %w", err)
+	}
+
+	switch cmd {
+	case CmdConnect:
+		return s.serveConnect(conn, dstAddr)
+	case CmdUDPAssociate:
+		return s.serveUDPAssociate(conn, dstAddr)
+	default:
+		s.sendReply(conn, repCommandNotSupported, "0.0.0.0:0")
+		return fmt.Errorf("unsupported command %#x", cmd)
+	}
+}
+
+// negotiateMethod runs the method-selection sub-negotiation (RFC 1928, Section 3).
+// It offers username/password (RFC 1929) when s.Authenticate is set, and
+// no-authentication-required only when s.Authenticate is nil: once an operator
+// configures Authenticate, every client must authenticate, so a client that
+// doesn't offer username/password is refused rather than let through unchecked.
+func (s *Server) negotiateMethod(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read method selection header: %w", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version: %#x", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("failed to read offered methods: %w", err)
+	}
+
+	selected := byte(methodNoAcceptable)
+	switch {
+	case s.Authenticate != nil:
+		if contains(methods, methodUsernamePassword) {
+			selected = methodUsernamePassword
+		}
+	case contains(methods, methodNoAuthRequired):
+		selected = methodNoAuthRequired
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, selected}); err != nil {
+		return fmt.Errorf("failed to send method selection reply: %w", err)
+	}
+	if selected == methodNoAcceptable {
+		return fmt.Errorf("no acceptable authentication method offered: %v", methods)
+	}
+	if selected == methodUsernamePassword {
+		return s.authenticate(conn)
+	}
+	return nil
+}
+
+// authenticate runs the username/password sub-negotiation (RFC 1929).
+func (s *Server) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read username/password header: %w", err)
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return fmt.Errorf("failed to read username: %w", err)
+	}
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passLen); err != nil {
+		return fmt.Errorf("failed to read password length: %w", err)
+	}
+	pass := make([]byte, passLen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+
+	const usernamePasswordVersion = 0x01
+	if !s.Authenticate(string(user), string(pass)) {
+		conn.Write([]byte{usernamePasswordVersion, 0x01})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err := conn.Write([]byte{usernamePasswordVersion, 0x00})
+	return err
+}
+
+func contains(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// sendReply writes a SOCKS5 reply with the given reply code and BND.ADDR/BND.PORT.
+func (s *Server) sendReply(conn net.Conn, rep byte, bindAddr string) error {
+	reply := []byte{socks5Version, rep, 0x00}
+	reply, err := appendSOCKS5Address(reply, bindAddr)
+	if err != nil {
+		return fmt.Errorf("failed to append bind address: %w", err)
+	}
+	_, err = conn.Write(reply)
+	return err
+}
+
+func (s *Server) serveConnect(conn net.Conn, dstAddr string) error {
+	target, err := s.StreamDialer.DialStream(context.Background(), dstAddr)
+	if err != nil {
+		s.sendReply(conn, repGeneralFailure, "0.0.0.0:0")
+		return fmt.Errorf("failed to connect to %v: %w", dstAddr, err)
+	}
+	defer target.Close()
+
+	if err := s.sendReply(conn, repSucceeded, target.LocalAddr().String()); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(target, conn)
+		target.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, target)
+	}()
+	wg.Wait()
+	return nil
+}
+
+// serveUDPAssociate implements the UDP ASSOCIATE command (RFC 1928, Section 7): it
+// binds a local UDP relay socket, advertises its address to the client, and relays
+// datagrams between the client and the destinations named in their SOCKS5 UDP
+// headers, using s.PacketDialer to reach each destination. The association ends
+// when the TCP control connection (conn) closes.
+func (s *Server) serveUDPAssociate(conn net.Conn, _ string) error {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		s.sendReply(conn, repGeneralFailure, "0.0.0.0:0")
+		return fmt.Errorf("failed to bind UDP relay socket: %w", err)
+	}
+	defer relay.Close()
+
+	if err := s.sendReply(conn, repSucceeded, relay.LocalAddr().String()); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	go func() {
+		// The association is only valid as long as the control connection is open.
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	if err := s.relayUDP(relay); !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	// relay is closed when the control connection ends, which ends the association normally.
+	return nil
+}
+
+// relayUDP pumps datagrams between the client bound to relay and the destinations
+// it addresses them to, until relay is closed.
+func (s *Server) relayUDP(relay *net.UDPConn) error {
+	var mu sync.Mutex
+	clientAddr, outbound := (*net.UDPAddr)(nil), map[string]net.Conn{}
+	var reassemblers = map[string]*fragmentReassembler{}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, out := range outbound {
+			out.Close()
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		if clientAddr == nil {
+			clientAddr = from
+		} else if !clientAddr.IP.Equal(from.IP) || clientAddr.Port != from.Port {
+			// The first sender is taken as the client; datagrams from any other address are ignored.
+			mu.Unlock()
+			continue
+		}
+		mu.Unlock()
+
+		frag, dstAddr, payload, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			s.logf("socks5: dropping malformed UDP datagram from %v: %v", from, err)
+			continue
+		}
+		if frag != 0 {
+			r, ok := reassemblers[dstAddr]
+			if !ok {
+				r = &fragmentReassembler{}
+				reassemblers[dstAddr] = r
+			}
+			data, done, err := r.append(frag, payload)
+			if err != nil {
+				s.logf("socks5: dropping malformed UDP fragment from %v: %v", from, err)
+				continue
+			}
+			if !done {
+				continue
+			}
+			payload = data
+		}
+
+		out, err := s.destination(relay, clientAddr, dstAddr, &mu, outbound)
+		if err != nil {
+			s.logf("socks5: failed to dial UDP destination %v: %v", dstAddr, err)
+			continue
+		}
+		if _, err := out.Write(payload); err != nil {
+			s.logf("socks5: failed to write to UDP destination %v: %v", dstAddr, err)
+		}
+	}
+}
+
+// destination returns the outbound connection to dstAddr, dialing and registering a
+// relay-back goroutine for it on first use.
+func (s *Server) destination(relay *net.UDPConn, clientAddr *net.UDPAddr, dstAddr string, mu *sync.Mutex, outbound map[string]net.Conn) (net.Conn, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if out, ok := outbound[dstAddr]; ok {
+		return out, nil
+	}
+
+	out, err := s.PacketDialer.DialPacket(context.Background(), dstAddr)
+	if err != nil {
+		return nil, err
+	}
+	outbound[dstAddr] = out
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := out.Read(buf)
+			if err != nil {
+				return
+			}
+			header, err := statute.UDPHeader{Addr: dstAddr}.MarshalBinary()
+			if err != nil {
+				continue
+			}
+			relay.WriteToUDP(append(header, buf[:n]...), clientAddr)
+		}
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func startEchoTCPServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(buf[:n])
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startEchoUDPServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startTestServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+	return ln.Addr().String()
+}
+
+func TestServerConnect(t *testing.T) {
+	echoAddr := startEchoTCPServer(t)
+	srv := &Server{StreamDialer: &transport.TCPDialer{}, PacketDialer: &transport.UDPDialer{}}
+	proxyAddr := startTestServer(t, srv)
+
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	conn, err := dialer.DialStream(context.Background(), echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestServerUDPAssociateClosesRelayGoroutinesOnEnd(t *testing.T) {
+	echoAddr := startEchoUDPServer(t)
+	srv := &Server{StreamDialer: &transport.TCPDialer{}, PacketDialer: &transport.UDPDialer{}}
+	proxyAddr := startTestServer(t, srv)
+
+	before := runtime.NumGoroutine()
+
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	conn, err := dialer.DialPacket(context.Background(), echoAddr)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before
+	}, time.Second, 10*time.Millisecond, "relay-back goroutine for the destination was not cleaned up")
+}
+
+func TestServerRejectsNoAuthWhenAuthenticateIsSet(t *testing.T) {
+	srv := &Server{
+		StreamDialer: &transport.TCPDialer{},
+		PacketDialer: &transport.UDPDialer{},
+		Authenticate: func(user, password string) bool {
+			return true
+		},
+	}
+	proxyAddr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{socks5Version, 1, methodNoAuthRequired})
+	require.NoError(t, err)
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{socks5Version, methodNoAcceptable}, reply)
+}
+
+func TestServerUDPAssociate(t *testing.T) {
+	echoAddr := startEchoUDPServer(t)
+	srv := &Server{StreamDialer: &transport.TCPDialer{}, PacketDialer: &transport.UDPDialer{}}
+	proxyAddr := startTestServer(t, srv)
+
+	dialer := NewDialer(&transport.TCPDialer{}, &transport.UDPDialer{}, proxyAddr)
+	conn, err := dialer.DialPacket(context.Background(), echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package statute defines the wire types of the SOCKS5 protocol (RFC 1928) that are
+// useful to construct and inspect independent of any particular client or server
+// connection, such as the header SOCKS5 prepends to UDP datagrams relayed under a
+// UDP ASSOCIATE session. It lets code building custom transports on top of SOCKS5
+// UDP — for example wrapping it in AEAD framing — produce and parse valid frames
+// without reimplementing the format.
+package statute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Address type octets (ATYP), as defined in RFC 1928, Section 5.
+const (
+	AtypIPv4       = 0x01
+	AtypDomainName = 0x03
+	AtypIPv6       = 0x04
+)
+
+// UDPHeader is the header SOCKS5 prepends to every UDP datagram relayed under a UDP
+// ASSOCIATE session (RFC 1928, Section 7).
+type UDPHeader struct {
+	// Frag is the fragment number: 0 for a standalone (non-fragmented) datagram, or
+	// 1..127 for a fragment in a sequence, with the high bit additionally set on the
+	// last fragment of the sequence.
+	Frag byte
+	// Addr is the datagram's destination (in a request) or origin (in a reply)
+	// address, as a "host:port" string.
+	Addr string
+}
+
+// MarshalBinary encodes h as its SOCKS5 wire representation: RSV, FRAG, ATYP, ADDR
+// and PORT. The address type is inferred from h.Addr.
+func (h UDPHeader) MarshalBinary() ([]byte, error) {
+	b := []byte{0x00, 0x00, h.Frag}
+	return AppendAddr(b, h.Addr)
+}
+
+// UnmarshalBinary decodes the SOCKS5 UDP header at the start of b into h. Any bytes
+// in b past the end of the header (the datagram's payload) are ignored; use
+// [ParseUDPHeader] to retrieve them.
+func (h *UDPHeader) UnmarshalBinary(b []byte) error {
+	parsed, _, err := ParseUDPHeader(b)
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+// ParseUDPHeader parses the SOCKS5 UDP header at the start of b and returns it along
+// with the payload that follows it.
+func ParseUDPHeader(b []byte) (UDPHeader, []byte, error) {
+	if len(b) < 4 {
+		return UDPHeader{}, nil, fmt.Errorf("invalid SOCKS5 UDP packet: too short")
+	}
+	if b[0] != 0x00 || b[1] != 0x00 {
+		return UDPHeader{}, nil, fmt.Errorf("invalid reserved bytes: expected 0x0000, got %#x%#x", b[0], b[1])
+	}
+	frag := b[2]
+	atyp := b[3]
+
+	r := bytesReader{b[4:]}
+	addr, err := ReadAddr(&r, atyp)
+	if err != nil {
+		return UDPHeader{}, nil, fmt.Errorf("failed to read destination address: %w", err)
+	}
+	return UDPHeader{Frag: frag, Addr: addr}, r.b, nil
+}
+
+// bytesReader is a minimal io.Reader over a byte slice that exposes the unread
+// remainder, used so ParseUDPHeader can hand ReadAddr a reader while recovering the
+// payload that follows the address without a second parse of the length.
+type bytesReader struct{ b []byte }
+
+func (r *bytesReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// AppendAddr appends the SOCKS5 wire representation of address (ATYP, ADDR and
+// PORT) to b, returning the extended slice.
+func AppendAddr(b []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long: %d bytes", len(host))
+		}
+		b = append(b, AtypDomainName, byte(len(host)))
+		b = append(b, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ReadAddr reads an ADDR and PORT of the given address type from r and returns it as
+// a "host:port" string. atyp must be one of the Atyp* constants.
+func ReadAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case AtypIPv4:
+		addr := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", fmt.Errorf("failed to read IPv4 address: %w", err)
+		}
+		host = net.IP(addr).String()
+	case AtypIPv6:
+		addr := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", fmt.Errorf("failed to read IPv6 address: %w", err)
+		}
+		host = net.IP(addr).String()
+	case AtypDomainName:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return "", fmt.Errorf("failed to read domain name length: %w", err)
+		}
+		domain := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", fmt.Errorf("failed to read domain name: %w", err)
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unknown address type %#x", atyp)
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return "", fmt.Errorf("failed to read port: %w", err)
+	}
+	port := binary.BigEndian.Uint16(portBuf)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
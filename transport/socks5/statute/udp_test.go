@@ -0,0 +1,59 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statute
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{"IPv4", "192.0.2.1:443"},
+		{"IPv6", "[2001:db8::1]:443"},
+		{"DomainName", "example.com:443"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := UDPHeader{Frag: 0x81, Addr: tc.addr}
+			b, err := want.MarshalBinary()
+			require.NoError(t, err)
+
+			var got UDPHeader
+			require.NoError(t, got.UnmarshalBinary(b))
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestParseUDPHeaderReturnsPayload(t *testing.T) {
+	header, err := UDPHeader{Addr: "192.0.2.1:443"}.MarshalBinary()
+	require.NoError(t, err)
+	packet := append(header, []byte("payload")...)
+
+	got, payload, err := ParseUDPHeader(packet)
+	require.NoError(t, err)
+	require.Equal(t, UDPHeader{Addr: "192.0.2.1:443"}, got)
+	require.Equal(t, "payload", string(payload))
+}
+
+func TestParseUDPHeaderRejectsBadReservedBytes(t *testing.T) {
+	_, _, err := ParseUDPHeader([]byte{0x01, 0x00, 0x00, AtypIPv4, 1, 2, 3, 4, 0, 80})
+	require.Error(t, err)
+}